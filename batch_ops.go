@@ -10,9 +10,10 @@ import (
 )
 
 type packRes struct {
-	C   anyvec.Creator
-	Ins []Seq
-	Out <-chan *anyseq.Batch
+	C    anyvec.Creator
+	Ins  []Seq
+	Out  <-chan *anyseq.Batch
+	Pool *BatchPool
 
 	Done        <-chan struct{}
 	LanesPerSeq []int
@@ -23,6 +24,17 @@ type packRes struct {
 // Pack aggregates multiple Seqs together into a single
 // Seq with larger batches.
 func Pack(c anyvec.Creator, seqs []Seq) Seq {
+	return PackWithPool(c, seqs, nil)
+}
+
+// PackWithPool is like Pack, but takes the Present slices of
+// its filler and joined batches out of pool instead of
+// allocating fresh ones every timestep. Fillers go back to
+// pool once joined; joined batches are not put back by
+// PackWithPool, and their Packed vectors are still freshly
+// concatenated. Pass a nil pool to get Pack's default
+// allocation behavior.
+func PackWithPool(c anyvec.Creator, seqs []Seq, pool *BatchPool) Seq {
 	outChan := make(chan *anyseq.Batch, 1)
 	doneChan := make(chan struct{})
 
@@ -30,6 +42,7 @@ func Pack(c anyvec.Creator, seqs []Seq) Seq {
 		C:           c,
 		Ins:         seqs,
 		Out:         outChan,
+		Pool:        pool,
 		Done:        doneChan,
 		LanesPerSeq: make([]int, len(seqs)),
 		Lens:        make([]int, len(seqs)),
@@ -55,6 +68,12 @@ func (p *packRes) Vars() anydiff.VarSet {
 }
 
 func (p *packRes) Propagate(upstream <-chan *anyseq.Batch, grad *Grad) {
+	// Users may depend on Propagate cleaning up the resources
+	// held by p.Forward() not being read. By the time Propagate
+	// runs, Forward() has normally already been fully drained
+	// by whatever consumed the forward pass (e.g. a
+	// SeqRereader), so this loop is usually a no-op; it is not
+	// where pooled batches get released (see BatchPool).
 	for _ = range p.Forward() {
 	}
 
@@ -100,6 +119,7 @@ func (p *packRes) forward(out chan<- *anyseq.Batch, done chan<- struct{}) {
 	for {
 		var numOpen int
 		var batches []*anyseq.Batch
+		var fillers []*anyseq.Batch
 		for inIdx, in := range p.Ins {
 			batch, ok := <-in.Forward()
 			if ok {
@@ -109,13 +129,22 @@ func (p *packRes) forward(out chan<- *anyseq.Batch, done chan<- struct{}) {
 				p.Lens[inIdx]++
 			} else {
 				lanes := p.LanesPerSeq[inIdx]
-				batches = append(batches, fillerBatch(c, lanes))
+				filler := fillerBatch(c, lanes, p.Pool)
+				batches = append(batches, filler)
+				fillers = append(fillers, filler)
 			}
 		}
 		if numOpen == 0 {
 			break
 		}
-		out <- joinBatches(c, batches)
+		out <- joinBatches(c, batches, p.Pool)
+
+		// joinBatches has already copied every filler's Present
+		// bits into the joined batch, so the fillers themselves
+		// are now free to recycle.
+		for _, filler := range fillers {
+			ReleaseBatch(p.Pool, filler)
+		}
 	}
 
 	for _, in := range p.Ins {
@@ -177,6 +206,7 @@ func (p *packRereaderRes) Reread(start, end int) <-chan *anyseq.Batch {
 		c := p.Creator()
 		for i := start; i < end; i++ {
 			var batches []*anyseq.Batch
+			var fillers []*anyseq.Batch
 			for inIdx, ch := range sourceChans {
 				batch, ok := <-ch
 				if ok {
@@ -185,10 +215,19 @@ func (p *packRereaderRes) Reread(start, end int) <-chan *anyseq.Batch {
 					p.Lens[inIdx]++
 				} else {
 					lanes := p.LanesPerSeq[inIdx]
-					batches = append(batches, fillerBatch(c, lanes))
+					filler := fillerBatch(c, lanes, p.Pool)
+					batches = append(batches, filler)
+					fillers = append(fillers, filler)
 				}
 			}
-			out <- joinBatches(c, batches)
+			out <- joinBatches(c, batches, p.Pool)
+
+			// joinBatches has already copied every filler's
+			// Present bits into the joined batch, so the fillers
+			// themselves are now free to recycle.
+			for _, filler := range fillers {
+				ReleaseBatch(p.Pool, filler)
+			}
 		}
 		close(out)
 	}()
@@ -199,6 +238,9 @@ func (p *packRereaderRes) Reread(start, end int) <-chan *anyseq.Batch {
 // splitUpstream splits an upstream batch into upstream
 // batches for each input.
 // If an input is not present yet, its batch is nil.
+// The returned batches slice into upBatch rather than
+// allocating, so they are not drawn from or returned to
+// p.Pool.
 func (p *packRes) splitUpstream(upBatch *anyseq.Batch) []*anyseq.Batch {
 	vecSize := upBatch.Packed.Len() / upBatch.NumPresent()
 	res := make([]*anyseq.Batch, len(p.Ins))
@@ -220,25 +262,3 @@ func (p *packRes) splitUpstream(upBatch *anyseq.Batch) []*anyseq.Batch {
 
 	return res
 }
-
-func joinBatches(c anyvec.Creator, batches []*anyseq.Batch) *anyseq.Batch {
-	var packed []anyvec.Vector
-	var present []bool
-	for _, batch := range batches {
-		// NumPresent is 0 if this is a filler batch.
-		if batch.NumPresent() != 0 {
-			packed = append(packed, batch.Packed)
-		}
-		present = append(present, batch.Present...)
-	}
-	return &anyseq.Batch{
-		Packed:  c.Concat(packed...),
-		Present: present,
-	}
-}
-
-// fillerBatch creates a placeholder batch that signifies
-// that a sequence batch has ended.
-func fillerBatch(c anyvec.Creator, lanes int) *anyseq.Batch {
-	return &anyseq.Batch{Present: make([]bool, lanes)}
-}
@@ -0,0 +1,119 @@
+package lazyrnn
+
+import (
+	"sync"
+
+	"github.com/unixpickle/anydiff/anyseq"
+	"github.com/unixpickle/anyvec"
+)
+
+// A BatchPool recycles the Present slices that Pack allocates
+// for every timestep of every packed sequence. It is keyed by
+// lane count, since Pack's batches only ever need one of a
+// handful of distinct sizes.
+//
+// A BatchPool is safe for concurrent use.
+//
+// A batch handed out by Get (directly, or via joinBatches or
+// fillerBatch) stays valid until something calls Put (or
+// ReleaseBatch) on it; at that point its Present slice may be
+// handed back out by a later Get, so callers must drop their
+// own references to it first. Releasing too early, while a
+// consumer still holds the batch, will silently corrupt that
+// consumer's data.
+type BatchPool struct {
+	mu      sync.Mutex
+	present map[int][][]bool
+}
+
+// NewBatchPool creates an empty BatchPool.
+func NewBatchPool() *BatchPool {
+	return &BatchPool{present: map[int][][]bool{}}
+}
+
+// Get returns a *anyseq.Batch whose Present slice has the
+// given number of lanes, reusing a slice from the pool if
+// one of that size is available and falling back to a fresh
+// allocation otherwise. The returned batch's Packed field is
+// left nil for the caller to fill in.
+func (b *BatchPool) Get(lanes int) *anyseq.Batch {
+	if b == nil {
+		return &anyseq.Batch{Present: make([]bool, lanes)}
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	bucket := b.present[lanes]
+	if len(bucket) == 0 {
+		return &anyseq.Batch{Present: make([]bool, lanes)}
+	}
+	present := bucket[len(bucket)-1]
+	b.present[lanes] = bucket[:len(bucket)-1]
+	return &anyseq.Batch{Present: present}
+}
+
+// Put returns batch's Present slice to the pool so a later
+// Get can reuse it. It is a no-op if batch or its Present
+// slice is nil. Put does not recycle batch.Packed, since
+// anyvec gives no way to reuse a Vector's backing storage.
+func (b *BatchPool) Put(batch *anyseq.Batch) {
+	if b == nil || batch == nil || batch.Present == nil {
+		return
+	}
+	present := batch.Present
+	for i := range present {
+		present[i] = false
+	}
+	b.mu.Lock()
+	b.present[len(present)] = append(b.present[len(present)], present)
+	b.mu.Unlock()
+}
+
+// ReleaseBatch returns batch to pool once it is no longer
+// needed, e.g. after a downstream Propagate has drained the
+// channel it was sent on. It is safe to call with a nil pool,
+// in which case it is a no-op.
+func ReleaseBatch(pool *BatchPool, batch *anyseq.Batch) {
+	pool.Put(batch)
+}
+
+// joinBatches concatenates batches, which each describe one
+// input's timestep in a packed sequence, into a single batch
+// covering all of the inputs' lanes.
+//
+// If pool is non-nil, the joined batch's Present slice is
+// taken from the pool instead of freshly allocated.
+func joinBatches(c anyvec.Creator, batches []*anyseq.Batch, pool *BatchPool) *anyseq.Batch {
+	var numLanes int
+	for _, batch := range batches {
+		numLanes += len(batch.Present)
+	}
+
+	res := pool.Get(numLanes)
+	present := res.Present[:0]
+
+	var packed []anyvec.Vector
+	for _, batch := range batches {
+		// NumPresent is 0 if this is a filler batch.
+		if batch.NumPresent() != 0 {
+			packed = append(packed, batch.Packed)
+		}
+		present = append(present, batch.Present...)
+	}
+
+	res.Present = present
+	res.Packed = c.Concat(packed...)
+	return res
+}
+
+// fillerBatch creates a placeholder batch that signifies
+// that a sequence batch has ended.
+//
+// If pool is non-nil, the batch's Present slice is taken from
+// the pool instead of freshly allocated; the caller must
+// release the returned batch back to pool once it has copied
+// its data out (see joinBatches' callers), or its Present
+// slice never returns to the pool and later Gets fall back to
+// fresh allocations.
+func fillerBatch(c anyvec.Creator, lanes int, pool *BatchPool) *anyseq.Batch {
+	return pool.Get(lanes)
+}
@@ -0,0 +1,46 @@
+package lazyrnn
+
+import "testing"
+
+func TestBatchPoolReuse(t *testing.T) {
+	pool := NewBatchPool()
+
+	b1 := pool.Get(3)
+	b1.Present[0] = true
+	b1.Present[2] = true
+	backing := b1.Present
+
+	pool.Put(b1)
+
+	b2 := pool.Get(3)
+	if &b2.Present[0] != &backing[0] {
+		t.Errorf("expected Get to hand back the released backing array")
+	}
+	for i, p := range b2.Present {
+		if p {
+			t.Errorf("expected Put to zero Present, but index %d is true", i)
+		}
+	}
+}
+
+func TestBatchPoolDifferentLanes(t *testing.T) {
+	pool := NewBatchPool()
+
+	b1 := pool.Get(2)
+	pool.Put(b1)
+
+	b2 := pool.Get(5)
+	if len(b2.Present) != 5 {
+		t.Errorf("expected a fresh 5-lane batch, got %d lanes", len(b2.Present))
+	}
+}
+
+func TestBatchPoolNil(t *testing.T) {
+	var pool *BatchPool
+	b := pool.Get(4)
+	if len(b.Present) != 4 {
+		t.Errorf("expected a nil pool to still allocate, got %d lanes", len(b.Present))
+	}
+	pool.Put(b)
+	ReleaseBatch(nil, b)
+}
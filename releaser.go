@@ -0,0 +1,16 @@
+package lazyseq
+
+import (
+	"github.com/unixpickle/anydiff/anyseq"
+)
+
+// Releaser is implemented by pools that can recycle a
+// *anyseq.Batch once its data has been copied elsewhere, such
+// as a lazyrnn.BatchPool. Tape implementations that accept a
+// Releaser call its Put method as soon as a batch has been
+// durably copied out of (e.g. written to disk or a store), so
+// the pool that produced it can hand its backing storage back
+// out, instead of never reclaiming anything.
+type Releaser interface {
+	Put(batch *anyseq.Batch)
+}
@@ -0,0 +1,451 @@
+package lazyseq
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/unixpickle/anydiff/anyseq"
+	"github.com/unixpickle/anyvec"
+	"github.com/unixpickle/anyvec/anyvecsave"
+	"github.com/unixpickle/essentials"
+)
+
+// DefaultChunkSize is the number of consecutive batches that
+// a CompressedTape groups into one compressed chunk if no
+// other chunk size is specified.
+const DefaultChunkSize = 32
+
+// CompressedTapeOptions configures a CompressedTape.
+//
+// A nil *CompressedTapeOptions is equivalent to the zero
+// value, which selects the default chunk size and the
+// default gzip compression level.
+type CompressedTapeOptions struct {
+	// ChunkSize is the number of consecutive batches that are
+	// grouped into a single compressed chunk.
+	// If 0, DefaultChunkSize is used.
+	ChunkSize int
+
+	// CompressionLevel is passed to gzip.NewWriterLevel.
+	// If nil, gzip.DefaultCompression is used. A pointer is
+	// used (rather than an int with 0 meaning "unset") because
+	// gzip.NoCompression is itself 0, and that needs to be
+	// distinguishable from "no level was specified".
+	CompressionLevel *int
+
+	// Releaser, if non-nil, has its Put method called with
+	// each batch once that batch's data has been copied into a
+	// compressed chunk on disk, so a pool backing the batches
+	// sent on the writer channel (e.g. a lazyrnn.BatchPool) can
+	// reclaim it. This is the only point in a CompressedTape's
+	// lifecycle where releasing a batch is safe, since earlier
+	// the batch may still be sitting unwritten in pending.
+	Releaser Releaser
+}
+
+func (o *CompressedTapeOptions) chunkSize() int {
+	if o == nil || o.ChunkSize == 0 {
+		return DefaultChunkSize
+	}
+	return o.ChunkSize
+}
+
+func (o *CompressedTapeOptions) compressionLevel() int {
+	if o == nil || o.CompressionLevel == nil {
+		return gzip.DefaultCompression
+	}
+	return *o.CompressionLevel
+}
+
+func (o *CompressedTapeOptions) releaser() Releaser {
+	if o == nil {
+		return nil
+	}
+	return o.Releaser
+}
+
+// chunkInfo is one entry of a CompressedTape's chunk index,
+// mapping a timestep range to the file offset and compressed
+// length of the chunk that holds it. The index is kept in
+// memory while writing and gob-encoded into the file's footer
+// once writing finishes.
+type chunkInfo struct {
+	Start         int
+	Count         int
+	Offset        int64
+	CompressedLen int64
+}
+
+// encodedBatch is the gob-friendly representation of a
+// *anyseq.Batch written into a chunk.
+type encodedBatch struct {
+	Present []bool
+	Packed  []byte
+}
+
+// CompressedTape is a Tape backed by a file, storing batches
+// in gzip-compressed chunks of a fixed size rather than one
+// allocation per timestep.
+//
+// Once the writer channel passed to NewCompressedTape is
+// closed, the chunk index is appended to the file as a
+// gob-encoded footer (writeDone fires after that), so a later
+// process can
+// reopen the file with OpenCompressedTape and read it back
+// without having redone the forward pass that produced it.
+// Until then, the index only lives in memory, where ReadTape
+// binary-searches it for the chunks spanning a requested range
+// and decompresses only those, rather than scanning the whole
+// file.
+type CompressedTape struct {
+	c    anyvec.Creator
+	f    *os.File
+	opts CompressedTapeOptions
+
+	live      chan *anyseq.Batch
+	writeDone chan struct{}
+
+	mu     sync.Mutex
+	done   bool
+	chunks []chunkInfo
+}
+
+// NewCompressedTape creates a CompressedTape backed by f and
+// a writer channel that feeds it batches.
+//
+// Batches sent on the returned channel are buffered in
+// memory until a full chunk is available, at which point the
+// chunk is compressed and appended to f. Closing the channel
+// flushes any partial final chunk and then the chunk-index
+// footer, after which the tape may be read with ReadTape, or
+// reopened from f in another process with OpenCompressedTape
+// once WriteDone has fired.
+//
+// For an example of creating a Tape with a corresponding
+// writer channel, see ReferenceTape.
+func NewCompressedTape(c anyvec.Creator, f *os.File,
+	opts *CompressedTapeOptions) (Tape, chan<- *anyseq.Batch) {
+	var o CompressedTapeOptions
+	if opts != nil {
+		o = *opts
+	}
+	t := &CompressedTape{
+		c:         c,
+		f:         f,
+		opts:      o,
+		live:      make(chan *anyseq.Batch, 1),
+		writeDone: make(chan struct{}),
+	}
+	writer := make(chan *anyseq.Batch, 1)
+	go t.writeLoop(writer)
+	return t, writer
+}
+
+// OpenCompressedTape reopens a file that NewCompressedTape
+// already wrote to completion (i.e. the writer channel was
+// closed and WriteDone fired), without re-running the forward
+// pass that produced it. The returned Tape only supports
+// ReadTape; there is no writer channel.
+func OpenCompressedTape(c anyvec.Creator, f *os.File,
+	opts *CompressedTapeOptions) (Tape, error) {
+	var o CompressedTapeOptions
+	if opts != nil {
+		o = *opts
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, essentials.AddCtx("open compressed tape", err)
+	}
+	if fi.Size() < 8 {
+		return nil, essentials.AddCtx("open compressed tape",
+			errors.New("file too small to contain a footer"))
+	}
+
+	var trailer [8]byte
+	if _, err := f.ReadAt(trailer[:], fi.Size()-8); err != nil {
+		return nil, essentials.AddCtx("open compressed tape", err)
+	}
+	footerOffset := int64(binary.LittleEndian.Uint64(trailer[:]))
+	footerLen := fi.Size() - 8 - footerOffset
+	if footerOffset < 0 || footerLen < 0 {
+		return nil, essentials.AddCtx("open compressed tape",
+			errors.New("corrupt footer offset"))
+	}
+
+	footerBytes := make([]byte, footerLen)
+	if _, err := f.ReadAt(footerBytes, footerOffset); err != nil {
+		return nil, essentials.AddCtx("open compressed tape", err)
+	}
+	var chunks []chunkInfo
+	if err := gob.NewDecoder(bytes.NewReader(footerBytes)).Decode(&chunks); err != nil {
+		return nil, essentials.AddCtx("open compressed tape", err)
+	}
+
+	return &CompressedTape{
+		c:      c,
+		f:      f,
+		opts:   o,
+		chunks: chunks,
+		done:   true,
+	}, nil
+}
+
+// WriteDone returns a channel that closes once every batch
+// sent on NewCompressedTape's writer channel has been flushed
+// to disk and the chunk-index footer has been written, so the
+// file is safe to reopen with OpenCompressedTape. It is nil
+// for a Tape returned by OpenCompressedTape.
+func (c *CompressedTape) WriteDone() <-chan struct{} {
+	return c.writeDone
+}
+
+// Creator returns the tape's anyvec.Creator.
+func (c *CompressedTape) Creator() anyvec.Creator {
+	return c.c
+}
+
+// ReadTape reads the timesteps in [start, end) from the tape.
+//
+// As a special case, ReadTape(0, -1) on a tape still being
+// written returns a channel that streams every batch as it is
+// written, mirroring the behavior ReferenceTape gives
+// SeqRereader for the initial forward pass. Any other range,
+// or any range at all on a tape that has finished writing or
+// was reopened with OpenCompressedTape, is served from disk,
+// binary-searching the chunk index for the chunks spanning
+// the range and decompressing only those. Only chunks already
+// written when ReadTape is called are read; it does not wait
+// for later ones, so timesteps still buffered in memory are
+// not returned.
+func (c *CompressedTape) ReadTape(start, end int) <-chan *anyseq.Batch {
+	c.mu.Lock()
+	done := c.done
+	chunks := c.chunks
+	c.mu.Unlock()
+	if start == 0 && end == -1 && c.live != nil && !done {
+		return c.live
+	}
+
+	if end == -1 {
+		end = totalChunkCount(chunks)
+	}
+	if start > end || start < 0 {
+		panic("lazyseq: slice bounds out of range")
+	}
+
+	out := make(chan *anyseq.Batch, 1)
+	go func() {
+		defer close(out)
+
+		idx := chunksFrom(chunks, start)
+		for i := idx; i < len(chunks) && chunks[i].Start < end; i++ {
+			batches, err := c.readChunk(chunks[i])
+			if err != nil {
+				panic(err)
+			}
+			for j, batch := range batches {
+				t := chunks[i].Start + j
+				if t < start || t >= end {
+					continue
+				}
+				out <- batch
+			}
+		}
+	}()
+	return out
+}
+
+// chunksFrom returns the index of the first chunk in chunks
+// (sorted by Start) that may contain timestep start, via a
+// binary search over the chunk index.
+func chunksFrom(chunks []chunkInfo, start int) int {
+	return sort.Search(len(chunks), func(i int) bool {
+		return chunks[i].Start+chunks[i].Count > start
+	})
+}
+
+// totalChunkCount returns the number of timesteps covered by
+// chunks (sorted by Start), i.e. the last chunk's Start+Count.
+func totalChunkCount(chunks []chunkInfo) int {
+	if len(chunks) == 0 {
+		return 0
+	}
+	last := chunks[len(chunks)-1]
+	return last.Start + last.Count
+}
+
+// writeLoop buffers incoming batches into chunks and writes
+// each full chunk to disk as it fills up.
+func (c *CompressedTape) writeLoop(writer <-chan *anyseq.Batch) {
+	var offset int64
+	var pending []*anyseq.Batch
+	var nextStart int
+	releaser := c.opts.releaser()
+
+	flush := func() {
+		if len(pending) == 0 {
+			return
+		}
+		n, err := c.writeChunk(offset, nextStart, pending)
+		if err != nil {
+			panic(err)
+		}
+		c.mu.Lock()
+		c.chunks = append(c.chunks, chunkInfo{
+			Start:         nextStart,
+			Count:         len(pending),
+			Offset:        offset,
+			CompressedLen: n,
+		})
+		c.mu.Unlock()
+		offset += n
+		nextStart += len(pending)
+
+		// writeChunk has already copied every batch's data into
+		// the compressed chunk, so it is now safe to recycle
+		// them.
+		if releaser != nil {
+			for _, batch := range pending {
+				releaser.Put(batch)
+			}
+		}
+		pending = nil
+	}
+
+	for batch := range writer {
+		c.live <- batch
+		pending = append(pending, batch)
+		if len(pending) >= c.opts.chunkSize() {
+			flush()
+		}
+	}
+	flush()
+	close(c.live)
+
+	if err := c.writeFooter(offset); err != nil {
+		panic(err)
+	}
+
+	c.mu.Lock()
+	c.done = true
+	c.mu.Unlock()
+	close(c.writeDone)
+}
+
+// writeFooter gob-encodes the chunk index and appends it to
+// the file at offset, followed by an 8-byte little-endian
+// trailer giving the index's offset, so OpenCompressedTape can
+// find and decode it without scanning the rest of the file.
+func (c *CompressedTape) writeFooter(offset int64) error {
+	var buf bytes.Buffer
+	c.mu.Lock()
+	err := gob.NewEncoder(&buf).Encode(c.chunks)
+	c.mu.Unlock()
+	if err != nil {
+		return essentials.AddCtx("write footer", err)
+	}
+	if _, err := c.f.WriteAt(buf.Bytes(), offset); err != nil {
+		return essentials.AddCtx("write footer", err)
+	}
+	var trailer [8]byte
+	binary.LittleEndian.PutUint64(trailer[:], uint64(offset))
+	if _, err := c.f.WriteAt(trailer[:], offset+int64(buf.Len())); err != nil {
+		return essentials.AddCtx("write footer", err)
+	}
+	return nil
+}
+
+// writeChunk gzip-compresses batches and appends them to the
+// file at offset. It returns the number of compressed bytes
+// written.
+func (c *CompressedTape) writeChunk(offset int64, start int,
+	batches []*anyseq.Batch) (int64, error) {
+	var raw bytes.Buffer
+	enc := gob.NewEncoder(&raw)
+	for _, batch := range batches {
+		eb, err := c.encodeBatch(batch)
+		if err != nil {
+			return 0, essentials.AddCtx("write chunk", err)
+		}
+		if err := enc.Encode(eb); err != nil {
+			return 0, essentials.AddCtx("write chunk", err)
+		}
+	}
+
+	var compressed bytes.Buffer
+	gw, err := gzip.NewWriterLevel(&compressed, c.opts.compressionLevel())
+	if err != nil {
+		return 0, essentials.AddCtx("write chunk", err)
+	}
+	if _, err := gw.Write(raw.Bytes()); err != nil {
+		return 0, essentials.AddCtx("write chunk", err)
+	}
+	if err := gw.Close(); err != nil {
+		return 0, essentials.AddCtx("write chunk", err)
+	}
+
+	if _, err := c.f.WriteAt(compressed.Bytes(), offset); err != nil {
+		return 0, essentials.AddCtx("write chunk", err)
+	}
+	return int64(compressed.Len()), nil
+}
+
+// readChunk decompresses and decodes the batches stored in a
+// single chunk.
+func (c *CompressedTape) readChunk(info chunkInfo) ([]*anyseq.Batch, error) {
+	raw := make([]byte, info.CompressedLen)
+	if _, err := c.f.ReadAt(raw, info.Offset); err != nil {
+		return nil, essentials.AddCtx("read chunk", err)
+	}
+	gr, err := gzip.NewReader(bytes.NewReader(raw))
+	if err != nil {
+		return nil, essentials.AddCtx("read chunk", err)
+	}
+	defer gr.Close()
+
+	dec := gob.NewDecoder(gr)
+	batches := make([]*anyseq.Batch, 0, info.Count)
+	for i := 0; i < info.Count; i++ {
+		var eb encodedBatch
+		if err := dec.Decode(&eb); err != nil {
+			return nil, essentials.AddCtx("read chunk", err)
+		}
+		batch, err := c.decodeBatch(&eb)
+		if err != nil {
+			return nil, essentials.AddCtx("read chunk", err)
+		}
+		batches = append(batches, batch)
+	}
+	return batches, nil
+}
+
+func (c *CompressedTape) encodeBatch(batch *anyseq.Batch) (*encodedBatch, error) {
+	eb := &encodedBatch{Present: batch.Present}
+	if batch.NumPresent() > 0 {
+		var buf bytes.Buffer
+		if err := anyvecsave.Write(&buf, batch.Packed); err != nil {
+			return nil, err
+		}
+		eb.Packed = buf.Bytes()
+	}
+	return eb, nil
+}
+
+func (c *CompressedTape) decodeBatch(eb *encodedBatch) (*anyseq.Batch, error) {
+	batch := &anyseq.Batch{Present: eb.Present}
+	if eb.Packed != nil {
+		vec, err := anyvecsave.Read(c.c, bytes.NewReader(eb.Packed))
+		if err != nil {
+			return nil, err
+		}
+		batch.Packed = vec
+	}
+	return batch, nil
+}
@@ -0,0 +1,111 @@
+package lazyseq
+
+import (
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/unixpickle/anydiff/anyseq"
+)
+
+func TestChunksFrom(t *testing.T) {
+	chunks := []chunkInfo{
+		{Start: 0, Count: 10},
+		{Start: 10, Count: 10},
+		{Start: 20, Count: 5},
+	}
+
+	cases := []struct {
+		start int
+		want  int
+	}{
+		{0, 0},
+		{9, 0},
+		{10, 1},
+		{19, 1},
+		{20, 2},
+		{24, 2},
+		{25, 3},
+		{100, 3},
+	}
+
+	for _, c := range cases {
+		if got := chunksFrom(chunks, c.start); got != c.want {
+			t.Errorf("start %d: expected index %d, got %d", c.start, c.want, got)
+		}
+	}
+
+	if got := chunksFrom(nil, 5); got != 0 {
+		t.Errorf("empty chunk index: expected 0, got %d", got)
+	}
+}
+
+// TestCompressedTapeRoundTrip writes a sequence of batches
+// through a CompressedTape, reads it back both live and from
+// the chunks it was split into, then reopens the file in a
+// fresh CompressedTape via OpenCompressedTape and checks that
+// it reads back the same way. Every batch here has no present
+// lanes, so Packed is never touched; anyvecsave's vector
+// encoding has no fake to exercise in this package's tests, but
+// the gzip/gob chunking, the footer, and ReadTape's binary
+// search are all exercised for real.
+func TestCompressedTapeRoundTrip(t *testing.T) {
+	want := [][]bool{
+		{false, false},
+		{false, false, false},
+		{false},
+		{false, false},
+		{false, false, false, false},
+		{false, false},
+	}
+
+	f, err := os.CreateTemp("", "lazyseq-compressed-tape")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	tape, writer := NewCompressedTape(nil, f, &CompressedTapeOptions{ChunkSize: 2})
+	liveRes := make(chan [][]bool, 1)
+	go func() {
+		liveRes <- readPresent(tape.ReadTape(0, -1))
+	}()
+	for _, present := range want {
+		writer <- &anyseq.Batch{Present: present}
+	}
+	close(writer)
+
+	ct := tape.(*CompressedTape)
+	<-ct.WriteDone()
+
+	if got := <-liveRes; !reflect.DeepEqual(got, want) {
+		t.Errorf("live read: expected %v, got %v", want, got)
+	}
+
+	if got := readPresent(tape.ReadTape(0, len(want))); !reflect.DeepEqual(got, want) {
+		t.Errorf("full read: expected %v, got %v", want, got)
+	}
+	if got := readPresent(tape.ReadTape(2, 5)); !reflect.DeepEqual(got, want[2:5]) {
+		t.Errorf("sub-range read: expected %v, got %v", want[2:5], got)
+	}
+
+	reopened, err := OpenCompressedTape(nil, f, nil)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	if got := readPresent(reopened.ReadTape(0, -1)); !reflect.DeepEqual(got, want) {
+		t.Errorf("reopened full read: expected %v, got %v", want, got)
+	}
+	if got := readPresent(reopened.ReadTape(1, 4)); !reflect.DeepEqual(got, want[1:4]) {
+		t.Errorf("reopened sub-range read: expected %v, got %v", want[1:4], got)
+	}
+}
+
+func readPresent(ch <-chan *anyseq.Batch) [][]bool {
+	var res [][]bool
+	for batch := range ch {
+		res = append(res, batch.Present)
+	}
+	return res
+}
@@ -0,0 +1,282 @@
+package lazyseq
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"sync"
+
+	"github.com/unixpickle/anydiff/anyseq"
+	"github.com/unixpickle/anyvec"
+	"github.com/unixpickle/anyvec/anyvecsave"
+	"github.com/unixpickle/essentials"
+)
+
+// KVStore is a minimal key-value store that KVTape persists
+// batches to. It is satisfied by a thin wrapper around most
+// embedded key-value databases, which the caller supplies;
+// NewLevelDBTape takes such a wrapper around a LevelDB handle
+// and is otherwise the same as NewKVTape. A KVStore that
+// buffers writes can additionally implement Syncer so that
+// KVTape.Flush has something to call.
+type KVStore interface {
+	Get(key []byte) ([]byte, error)
+	Put(key, value []byte) error
+
+	// Iterate calls f with every key/value pair whose key has
+	// the given prefix, in ascending key order, stopping early
+	// if f returns false. Implementations must allow Iterate to
+	// be called concurrently with Put.
+	Iterate(prefix []byte, f func(key, value []byte) bool) error
+}
+
+// KVTape is a Tape backed by a KVStore rather than a file or
+// RAM, so it survives across process restarts.
+//
+// Batches are stored under keys "<tape-id>/<timestep>", with
+// the timestep zero-padded so keys sort in timestep order.
+// Present is stored as a bitset and Packed as the vector's
+// serialized data plus a creator-name tag (via anyvecsave),
+// so a tape written by one process can be read back by
+// another with a compatible anyvec.Creator.
+//
+// ReadTape only ever returns timesteps already committed to
+// the store, so it is safe to call while the writer goroutine
+// is still writing.
+type KVTape struct {
+	db     KVStore
+	tapeID string
+	c      anyvec.Creator
+
+	mu        sync.Mutex
+	cond      *sync.Cond
+	committed int
+	closed    bool
+}
+
+// NewLevelDBTape creates a KVTape backed by db and a writer
+// channel that feeds it batches, for the common case of
+// persisting to a LevelDB-like store.
+//
+// releaser, if non-nil, has its Put method called with each
+// batch once it has been durably written to db, so a pool
+// backing the batches sent on the writer channel (e.g. a
+// lazyrnn.BatchPool) can reclaim it. Pass nil if the batches
+// aren't pooled.
+//
+// For an example of creating a Tape with a corresponding
+// writer channel, see ReferenceTape.
+func NewLevelDBTape(c anyvec.Creator, db KVStore, tapeID string,
+	releaser Releaser) (*KVTape, chan<- *anyseq.Batch) {
+	return NewKVTape(c, db, tapeID, releaser)
+}
+
+// NewKVTape is like NewLevelDBTape, but for any KVStore.
+func NewKVTape(c anyvec.Creator, db KVStore, tapeID string,
+	releaser Releaser) (*KVTape, chan<- *anyseq.Batch) {
+	t := &KVTape{db: db, tapeID: tapeID, c: c}
+	t.cond = sync.NewCond(&t.mu)
+
+	writer := make(chan *anyseq.Batch, 1)
+	go func() {
+		timestep := 0
+		for batch := range writer {
+			if err := t.writeBatch(timestep, batch); err != nil {
+				panic(err)
+			}
+			t.mu.Lock()
+			t.committed++
+			t.cond.Broadcast()
+			t.mu.Unlock()
+
+			// writeBatch has already copied the batch's data into
+			// db, so it is now safe to recycle it.
+			if releaser != nil {
+				releaser.Put(batch)
+			}
+			timestep++
+		}
+		t.Close()
+	}()
+	return t, writer
+}
+
+// Resume reconstructs a Rereader from a KVTape that a
+// previous process already finished writing, without
+// re-running the forward pass that produced it.
+func Resume(c anyvec.Creator, db KVStore, tapeID string) Rereader {
+	t := &KVTape{db: db, tapeID: tapeID, c: c}
+	t.cond = sync.NewCond(&t.mu)
+	t.committed = t.countCommitted()
+	t.closed = true
+	return TapeRereader(t)
+}
+
+// Creator returns the tape's anyvec.Creator.
+func (t *KVTape) Creator() anyvec.Creator {
+	return t.c
+}
+
+// Syncer is an optional interface a KVStore may implement to
+// force its buffered writes to stable storage. If a KVTape's
+// store implements Syncer, Flush calls it; otherwise Flush is
+// a no-op, since there's nothing for KVTape to flush on the
+// caller's behalf.
+type Syncer interface {
+	Sync() error
+}
+
+// Flush forces the tape's store to durably persist everything
+// written so far, if its KVStore implements Syncer. It is a
+// no-op otherwise, so callers backed by a store that already
+// persists every Put immediately (e.g. most LevelDB setups)
+// don't need to call it at all.
+func (t *KVTape) Flush() error {
+	if s, ok := t.db.(Syncer); ok {
+		return s.Sync()
+	}
+	return nil
+}
+
+// Close marks the tape as fully written, waking any pending
+// ReadTape calls that were waiting on further timesteps.
+func (t *KVTape) Close() error {
+	t.mu.Lock()
+	t.closed = true
+	t.cond.Broadcast()
+	t.mu.Unlock()
+	return nil
+}
+
+// ReadTape reads the timesteps in [start, end) from the
+// store, blocking as needed until each timestep has been
+// committed. As with other Tapes, end of -1 means "until the
+// tape is closed".
+func (t *KVTape) ReadTape(start, end int) <-chan *anyseq.Batch {
+	if start < 0 || (end != -1 && start > end) {
+		panic("lazyseq: slice bounds out of range")
+	}
+
+	out := make(chan *anyseq.Batch, 1)
+	go func() {
+		defer close(out)
+		for i := start; end == -1 || i < end; i++ {
+			batch, ok := t.waitCommitted(i)
+			if !ok {
+				return
+			}
+			out <- batch
+		}
+	}()
+	return out
+}
+
+// waitCommitted blocks until timestep i has been committed,
+// and returns false instead if the tape was closed first.
+func (t *KVTape) waitCommitted(i int) (*anyseq.Batch, bool) {
+	t.mu.Lock()
+	for i >= t.committed && !t.closed {
+		t.cond.Wait()
+	}
+	done := i >= t.committed
+	t.mu.Unlock()
+	if done {
+		return nil, false
+	}
+
+	batch, err := t.readBatch(i)
+	if err != nil {
+		panic(err)
+	}
+	return batch, true
+}
+
+// countCommitted counts the keys already stored under the
+// tape's prefix, for resuming a tape that a previous process
+// finished writing.
+func (t *KVTape) countCommitted() int {
+	var n int
+	t.db.Iterate([]byte(t.tapeID+"/"), func(key, value []byte) bool {
+		n++
+		return true
+	})
+	return n
+}
+
+func (t *KVTape) key(timestep int) []byte {
+	return []byte(fmt.Sprintf("%s/%020d", t.tapeID, timestep))
+}
+
+func (t *KVTape) writeBatch(timestep int, batch *anyseq.Batch) error {
+	var packed []byte
+	if batch.NumPresent() > 0 {
+		var buf bytes.Buffer
+		if err := anyvecsave.Write(&buf, batch.Packed); err != nil {
+			return essentials.AddCtx("write kv tape batch", err)
+		}
+		packed = buf.Bytes()
+	}
+	value := encodeKVValue(len(batch.Present), packPresent(batch.Present), packed)
+	return t.db.Put(t.key(timestep), value)
+}
+
+func (t *KVTape) readBatch(timestep int) (*anyseq.Batch, error) {
+	value, err := t.db.Get(t.key(timestep))
+	if err != nil {
+		return nil, essentials.AddCtx("read kv tape batch", err)
+	}
+	lanes, presentBytes, packedBytes := decodeKVValue(value)
+	batch := &anyseq.Batch{Present: unpackPresent(presentBytes, lanes)}
+	if len(packedBytes) > 0 {
+		vec, err := anyvecsave.Read(t.c, bytes.NewReader(packedBytes))
+		if err != nil {
+			return nil, essentials.AddCtx("read kv tape batch", err)
+		}
+		batch.Packed = vec
+	}
+	return batch, nil
+}
+
+// encodeKVValue frames a timestep's lane count, Present
+// bitset, and serialized Packed vector into a single value
+// for storage under one key.
+func encodeKVValue(lanes int, present, packed []byte) []byte {
+	var buf bytes.Buffer
+	var lenBuf [8]byte
+	binary.LittleEndian.PutUint64(lenBuf[:], uint64(lanes))
+	buf.Write(lenBuf[:])
+	binary.LittleEndian.PutUint64(lenBuf[:], uint64(len(present)))
+	buf.Write(lenBuf[:])
+	buf.Write(present)
+	buf.Write(packed)
+	return buf.Bytes()
+}
+
+func decodeKVValue(value []byte) (lanes int, present, packed []byte) {
+	lanes = int(binary.LittleEndian.Uint64(value[:8]))
+	presentLen := int(binary.LittleEndian.Uint64(value[8:16]))
+	present = value[16 : 16+presentLen]
+	packed = value[16+presentLen:]
+	return lanes, present, packed
+}
+
+// packPresent bit-packs a Present slice into bytes.
+func packPresent(present []bool) []byte {
+	out := make([]byte, (len(present)+7)/8)
+	for i, p := range present {
+		if p {
+			out[i/8] |= 1 << uint(i%8)
+		}
+	}
+	return out
+}
+
+// unpackPresent is the inverse of packPresent, expanding n
+// bits back into a []bool.
+func unpackPresent(data []byte, n int) []bool {
+	out := make([]bool, n)
+	for i := range out {
+		out[i] = data[i/8]&(1<<uint(i%8)) != 0
+	}
+	return out
+}
@@ -0,0 +1,43 @@
+package lazyseq
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPackPresentRoundTrip(t *testing.T) {
+	cases := [][]bool{
+		{},
+		{true},
+		{false},
+		{true, false, true, true, false, false, true, false},
+		{true, false, true, true, false, false, true, false, true},
+	}
+	for _, present := range cases {
+		packed := packPresent(present)
+		out := unpackPresent(packed, len(present))
+		if !reflect.DeepEqual(out, present) {
+			t.Errorf("round trip mismatch: expected %v, got %v", present, out)
+		}
+	}
+}
+
+func TestEncodeKVValueRoundTrip(t *testing.T) {
+	lanes := 11
+	present := packPresent([]bool{true, false, true, true, false, false, true,
+		false, true, true, false})
+	packed := []byte("some serialized vector bytes")
+
+	value := encodeKVValue(lanes, present, packed)
+	gotLanes, gotPresent, gotPacked := decodeKVValue(value)
+
+	if gotLanes != lanes {
+		t.Errorf("expected lanes %d, got %d", lanes, gotLanes)
+	}
+	if !reflect.DeepEqual(gotPresent, present) {
+		t.Errorf("expected present %v, got %v", present, gotPresent)
+	}
+	if !reflect.DeepEqual(gotPacked, packed) {
+		t.Errorf("expected packed %v, got %v", packed, gotPacked)
+	}
+}